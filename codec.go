@@ -0,0 +1,72 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+import (
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses and decompresses the bytes of a single block. A Codec
+// is set on Options.Codec and used transparently by Block.Commit and
+// Heap.GetBlock.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte, size int64) ([]byte, error)
+}
+
+// SnappyCodec compresses blocks with snappy. It favours speed over ratio
+// and is safe for concurrent use.
+var SnappyCodec Codec = snappyCodec{}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCodec) Decompress(data []byte, size int64) ([]byte, error) {
+	return snappy.Decode(make([]byte, 0, size), data)
+}
+
+// zstdCodec compresses blocks with zstd, trading CPU for a tighter ratio
+// than SnappyCodec. Use NewZstdCodec to construct one.
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewZstdCodec builds a Codec backed by zstd at the default compression
+// level. The returned Codec is safe for concurrent use and should be
+// constructed once and reused across Heaps.
+func NewZstdCodec() (Codec, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCodec{encoder, decoder}, nil
+}
+
+func (c *zstdCodec) Compress(data []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCodec) Decompress(data []byte, size int64) ([]byte, error) {
+	return c.decoder.DecodeAll(data, make([]byte, 0, size))
+}
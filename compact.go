@@ -0,0 +1,148 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+import "syscall"
+
+// Compact rewrites every region's live blocks contiguously from the region
+// header upward, eliminating internal fragmentation, then tries to drain
+// blocks out of the tail regions into earlier ones so a following
+// TruncateEmptyRegions call has something to reclaim. It serializes with
+// Allocate/Free/GetBlock/etc. via h.mu and r.mu the same as they serialize
+// with each other, so it's safe to call on an open, writable heap from that
+// angle, and runs incrementally region-by-region; progress, if non-nil, is
+// called with (regions compacted so far, total regions) after each one.
+// What it does NOT do is protect a *Block a caller is already holding, or
+// mid-flight through GetBlock: Compact slides live bytes down to a lower
+// offset in place (see region.compact), and neither that move nor the
+// reader's access to Block.Bytes takes any lock. The caller is responsible
+// for making sure nothing reads a Block's Bytes while Compact is running
+// against its region (see the Block.Bytes doc comment).
+func (h *Heap) Compact(progress func(done, total int)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	total := len(h.regions)
+	for i, r := range h.regions {
+		r.compact()
+		if progress != nil {
+			progress(i+1, total)
+		}
+	}
+	h.drainTrailingRegions()
+	return nil
+}
+
+// drainTrailingRegions walks regions from the end backward, relocating
+// every live block it can into an earlier region. It stops at the first
+// region it can't fully drain, since that and everything before it can no
+// longer be a trailing run of empty regions.
+func (h *Heap) drainTrailingRegions() {
+	for i := len(h.regions) - 1; i > 0; i-- {
+		r := h.regions[i]
+		for _, b := range r.Blocks() {
+			if !h.relocateBlock(r, i, b) {
+				return
+			}
+		}
+	}
+}
+
+// relocateBlock copies b's stored bytes into the first earlier region with
+// room for them, then turns b's slot in the donor region into a relocation
+// marker pointing at the new BlockId.
+func (h *Heap) relocateBlock(donor *region, donorIndex int, b *Block) bool {
+	flags, uncompressedSize := donor.getBlockListEntry(b.Id)
+	for j := 0; j < donorIndex; j++ {
+		dest := h.regions[j]
+		nb, err := dest.Allocate(b.Size)
+		if err != nil {
+			continue
+		}
+		copy(dest.d[nb.Offset:nb.Offset+b.Size], donor.d[b.Offset:b.Offset+b.Size])
+		dest.mu.Lock()
+		dest.setBlockListEntryFull(nb.Id, nb.Offset, b.Size, flags, uncompressedSize)
+		dest.mu.Unlock()
+		donor.mu.Lock()
+		donor.setRelocation(b.Id, nb.Id)
+		donor.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// TruncateEmptyRegions drops any contiguous run of fully-empty regions at
+// the end of the heap, unmapping them and shrinking the underlying file so
+// the space is actually returned to the filesystem. Run Compact first so
+// trailing regions get a chance to be drained down to nothing. BlockIds
+// that pointed into a truncated region keep resolving: their relocation
+// markers are durably recorded (see relocations.go) before the region
+// holding them disappears, so they still resolve after a Close/reopen, not
+// just for the rest of this process.
+func (h *Heap) TruncateEmptyRegions() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for len(h.regions) > 1 {
+		last := h.regions[len(h.regions)-1]
+		if len(last.Blocks()) > 0 {
+			break
+		}
+		if err := h.hoistRelocations(last); err != nil {
+			return err
+		}
+		size := int64(len(last.d))
+		if err := syscall.Munmap(last.d); err != nil {
+			return err
+		}
+		if err := h.f.Truncate(h.fileSize() - size); err != nil {
+			return err
+		}
+		h.regions = h.regions[:len(h.regions)-1]
+	}
+	return nil
+}
+
+func (h *Heap) fileSize() int64 {
+	i, err := h.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return i.Size()
+}
+
+// hoistRelocations copies every relocation marker in r into h.relocations,
+// appending each to h.relocFile first, so BlockIds that used to live in r
+// keep resolving once r is truncated away, even across a Close/reopen. It
+// stops and returns an error before dropping r if any record fails to
+// write, rather than truncating the region out from under a relocation
+// that isn't actually durable yet.
+func (h *Heap) hoistRelocations(r *region) error {
+	max := r.getNextFreeBlockId()
+	for i := NewBlockId(r.id, 0); i < max; i++ {
+		target, ok := r.resolveRelocation(i)
+		if !ok {
+			continue
+		}
+		if h.relocFile != nil {
+			if err := appendRelocation(h.relocFile, i, target); err != nil {
+				return err
+			}
+		}
+		if h.relocations == nil {
+			h.relocations = map[BlockId]BlockId{}
+		}
+		h.relocations[i] = target
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SizeHistogram buckets block counts by their exact size in bytes.
+type SizeHistogram map[int64]int64
+
+// Stats summarises the allocation state of a Heap, similar in spirit to
+// lldb's AllocStats.
+type Stats struct {
+	AllocBytes int64
+	AllocAtoms int64
+	FreeBytes  int64
+	FreeAtoms  int64
+	AllocSizes SizeHistogram
+	FreeSizes  SizeHistogram
+}
+
+func newStats() Stats {
+	return Stats{AllocSizes: SizeHistogram{}, FreeSizes: SizeHistogram{}}
+}
+
+func (s *Stats) add(other Stats) {
+	s.AllocBytes += other.AllocBytes
+	s.AllocAtoms += other.AllocAtoms
+	s.FreeBytes += other.FreeBytes
+	s.FreeAtoms += other.FreeAtoms
+	for size, n := range other.AllocSizes {
+		s.AllocSizes[size] += n
+	}
+	for size, n := range other.FreeSizes {
+		s.FreeSizes[size] += n
+	}
+}
+
+// Stats returns allocation bookkeeping across every region in the heap.
+func (h *Heap) Stats() Stats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	total := newStats()
+	for _, r := range h.regions {
+		total.add(r.stats())
+	}
+	return total
+}
+
+func (r *region) stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := newStats()
+	max := r.getNextFreeBlockId()
+	for i := NewBlockId(r.id, 0); i < max; i++ {
+		d := r.getBlockListEntryBytes(i)
+		size := r.readInt64(d[8:16])
+		switch {
+		case size > 0:
+			s.AllocBytes += size
+			s.AllocAtoms++
+			s.AllocSizes[size]++
+		case size < 0:
+			s.FreeBytes += -size
+			s.FreeAtoms++
+			s.FreeSizes[-size]++
+		}
+	}
+	return s
+}
+
+// Verify walks every region's block list checking that live blocks and free
+// runs don't overlap or run out of bounds, and that the free list is fully
+// coalesced. It returns the first inconsistency found, or nil if the heap
+// is internally consistent.
+func (h *Heap) Verify() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, r := range h.regions {
+		if err := r.verify(); err != nil {
+			return fmt.Errorf("region %d: %s", r.id, err)
+		}
+	}
+	return nil
+}
+
+func (r *region) verify() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	type span struct{ offset, size int64 }
+	max := r.getNextFreeBlockId()
+	spans := make([]span, 0, max.BlockId())
+	for i := NewBlockId(r.id, 0); i < max; i++ {
+		d := r.getBlockListEntryBytes(i)
+		offset, size := r.readInt64(d[0:8]), r.readInt64(d[8:16])
+		if size == 0 {
+			continue
+		}
+		if size < 0 {
+			size = -size
+		}
+		if offset < regionHeaderSize || offset+size > r.getFreePointer() {
+			return fmt.Errorf("block %v out of bounds: offset=%d size=%d", i, offset, size)
+		}
+		spans = append(spans, span{offset, size})
+	}
+	sort.Slice(spans, func(a, b int) bool { return spans[a].offset < spans[b].offset })
+	for i := 1; i < len(spans); i++ {
+		if spans[i-1].offset+spans[i-1].size > spans[i].offset {
+			return fmt.Errorf("overlapping blocks at offset %d", spans[i].offset)
+		}
+	}
+	for i := 1; i < len(r.freeList); i++ {
+		if r.freeList[i-1].offset+r.freeList[i-1].size == r.freeList[i].offset {
+			return fmt.Errorf("adjacent free runs were not coalesced at offset %d", r.freeList[i].offset)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"unsafe"
+)
+
+// InvalidChecksum is returned by openRegion when a format-3-or-later
+// region's header doesn't match its stored CRC32C, which means the file
+// was truncated or corrupted rather than merely written on another host.
+var InvalidChecksum = fmt.Errorf("region header failed its CRC32C check")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// getInt64 and putInt64 read/write the explicit little-endian encoding used
+// by every region field from format version 3 onward, so the file is
+// portable between hosts of either endianness.
+func getInt64(b []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(b[:8]))
+}
+
+func putInt64(b []byte, v int64) {
+	binary.LittleEndian.PutUint64(b[:8], uint64(v))
+}
+
+// hostInt64 and putHostInt64 read/write a field the way every region before
+// format version 3 did: a raw in-memory int64, whatever the host's native
+// endianness happens to be. Kept only so openRegion can read a legacy
+// region long enough to migrate it.
+func hostInt64(b []byte) int64 {
+	return *(*int64)(unsafe.Pointer(&b[0]))
+}
+
+func putHostInt64(b []byte, v int64) {
+	*(*int64)(unsafe.Pointer(&b[0])) = v
+}
+
+// readInt64 and writeInt64 read/write an 8-byte region field using whichever
+// encoding r.legacy says the region is currently stored in. Every region
+// field access in this package goes through these two, so a legacy region
+// keeps working right up until migrate() flips it over.
+func (r *region) readInt64(b []byte) int64 {
+	if r.legacy {
+		return hostInt64(b)
+	}
+	return getInt64(b)
+}
+
+func (r *region) writeInt64(b []byte, v int64) {
+	if r.legacy {
+		putHostInt64(b, v)
+		return
+	}
+	putInt64(b, v)
+}
+
+// updateHeaderCRC recomputes and stores the CRC32C covering the fixed
+// header fields. Called whenever one of them changes; cheap, since the
+// header is a handful of bytes regardless of region size.
+func (r *region) updateHeaderCRC() {
+	crc := crc32.Checksum(r.d[:regionCRCOffset], crc32cTable)
+	binary.LittleEndian.PutUint32(r.d[regionCRCOffset:regionCRCOffset+4], crc)
+}
+
+// headerCRCValid reports whether the stored CRC32C matches the header's
+// current contents.
+func (r *region) headerCRCValid() bool {
+	crc := crc32.Checksum(r.d[:regionCRCOffset], crc32cTable)
+	return binary.LittleEndian.Uint32(r.d[regionCRCOffset:regionCRCOffset+4]) == crc
+}
+
+// migrate rewrites a region opened from a pre-format-3 file onto the
+// current format: every header and block-list field is re-encoded as
+// little-endian instead of host-endian, live block bytes are shifted
+// forward to make room for the header's new CRC field, and a fresh CRC32C
+// is stamped. It's only called for a writeable, legacy region; a region
+// opened read-only is left in legacy mode and keeps being read through
+// readInt64's host-endian path.
+//
+// This can only repair a region written on a host of the same endianness
+// as the one running this migration: a pre-format-3 region moved from a
+// big-endian host to a little-endian one (or vice versa) has no
+// self-describing tag to recover its byte order from, since the format
+// being fixed here is exactly the one that didn't carry one. That's the
+// case this whole change exists to prevent going forward; it can't be
+// reconstructed retroactively.
+func (r *region) migrate() error {
+	if !r.legacy {
+		return nil
+	}
+	shift := int64(regionHeaderSize - legacyRegionHeaderSize)
+	oldFreePtr := hostInt64(r.d[regionFreePointerOffset : regionFreePointerOffset+8])
+	newFreePtr := oldFreePtr + shift
+	tailBoundary := int64(len(r.d)) - blockListHeaderSize - r.getNextFreeBlockId().BlockId()*blockListEntrySize
+	if newFreePtr > tailBoundary {
+		// No room to grow the header in place without clobbering live
+		// data or the block list. Leave the region in legacy mode; it'll
+		// keep working via the host-endian path, just without a CRC.
+		return fmt.Errorf("region %d: not enough free space to migrate to format %d in place", r.id, currentFormatVersion)
+	}
+
+	rid := hostInt64(r.d[regionId : regionId+8])
+	size := hostInt64(r.d[regionSizeOffset : regionSizeOffset+8])
+	max := r.getNextFreeBlockId()
+
+	copy(r.d[regionHeaderSize:regionHeaderSize+(oldFreePtr-legacyRegionHeaderSize)], r.d[legacyRegionHeaderSize:oldFreePtr])
+
+	for i := NewBlockId(rid, 0); i < max; i++ {
+		d := r.getBlockListEntryBytes(i)
+		flags := d[blockListEntryFlagsOffset]
+		offset := hostInt64(d[blockListEntryOffsetOffset : blockListEntryOffsetOffset+8])
+		entrySize := hostInt64(d[blockListEntrySizeOffset : blockListEntrySizeOffset+8])
+		uncompressedSize := hostInt64(d[blockListEntryUncompressedOffset : blockListEntryUncompressedOffset+8])
+		if flags&blockFlagRelocated == 0 {
+			offset += shift
+		}
+		putInt64(d[blockListEntryOffsetOffset:blockListEntryOffsetOffset+8], offset)
+		putInt64(d[blockListEntrySizeOffset:blockListEntrySizeOffset+8], entrySize)
+		putInt64(d[blockListEntryUncompressedOffset:blockListEntryUncompressedOffset+8], uncompressedSize)
+	}
+
+	putInt64(r.d[regionFreePointerOffset:regionFreePointerOffset+8], newFreePtr)
+	putInt64(r.d[regionSizeOffset:regionSizeOffset+8], size)
+	putInt64(r.d[regionId:regionId+8], rid)
+	putInt64(r.d[regionFormatVersion:regionFormatVersion+8], currentFormatVersion)
+	putInt64(r.blockListNextIdPtr, max.BlockId())
+	r.legacy = false
+	r.updateHeaderCRC()
+	return nil
+}
@@ -19,6 +19,7 @@ package vheap
 import (
 	"errors"
 	"os"
+	"sync"
 )
 
 var (
@@ -27,52 +28,191 @@ var (
 )
 
 type Heap struct {
-	f       *os.File
-	regions []*region
+	f    *os.File
+	opts Options
+
+	// mu guards the regions slice itself (growth in Allocate/AllocateN,
+	// shrinkage in TruncateEmptyRegions) and the relocations map below.
+	// It does not guard what happens inside a single *region; that's
+	// region.mu's job. Read-only access to an existing *region (GetBlock,
+	// Blocks, Available) only needs mu held long enough to snapshot the
+	// slice/pointer, since regions are never mutated in place, only
+	// appended or dropped from the end.
+	mu        sync.RWMutex
+	regions   []*region
+	wal       *walLog
+	relocFile *os.File
+
+	// relocations forwards BlockIds whose region was reclaimed by
+	// TruncateEmptyRegions to wherever Compact moved them. Loaded from,
+	// and kept in sync with, relocFile (the "<name>.reloc" file next to
+	// the heap), so it survives a close/reopen. Guarded by mu.
+	relocations map[BlockId]BlockId
 }
 
-func OpenForUpdate(filename string, regionSizeMb int64) (*Heap, error) {
+// maxRelocationHops bounds how many times GetBlock will follow a
+// relocation before giving up, guarding against a corrupt relocation cycle.
+const maxRelocationHops = 64
+
+func OpenForUpdate(filename string, regionSizeMb int64, opts Options) (*Heap, error) {
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
 	}
+	wal, records, err := openWAL(filename + ".wal")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	i, err := f.Stat()
 	if err != nil {
+		f.Close()
+		wal.close()
 		return nil, err
 	}
 	// Newly created, append region.
 	var h *Heap
 	if i.Size() == 0 {
-		r, err := appendRegion(0, f, regionSizeMb*1024*1024)
+		r, err := appendRegion(0, f, regionSizeMb*1024*1024, opts)
 		if err != nil {
 			f.Close()
+			wal.close()
 			return nil, err
 		}
-		h = &Heap{f, []*region{r}}
+		h = &Heap{f: f, opts: opts, regions: []*region{r}}
 	} else {
-		h, err = initHeap(f, true)
+		h, err = initHeap(f, true, opts)
 		if err != nil {
 			f.Close()
+			wal.close()
 			return nil, err
 		}
 	}
+	// Replay before the WAL is attached to any region, so this doesn't
+	// re-log the mutations it's merely restoring.
+	h.replay(records)
+	h.wal = wal
+	for _, r := range h.regions {
+		r.log = wal
+	}
+	relocFile, relocations, err := openRelocations(filename + ".reloc")
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.relocFile = relocFile
+	h.relocations = relocations
 	return h, nil
 }
 
-func Open(filename string) (*Heap, error) {
+// Open opens filename read-only. opts must match the Options the heap was
+// last opened with via OpenForUpdate: in particular, if any block was
+// written with a Codec configured, the same Codec must be passed here, or
+// GetBlock/Blocks will report those blocks as unreadable rather than
+// silently handing back their still-compressed bytes.
+func Open(filename string, opts Options) (*Heap, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	return initHeap(f, false)
+	return initHeap(f, false, opts)
 }
 
+// Close releases every resource backing the heap. It must not be called
+// concurrently with an in-flight Allocate/Free/GetBlock/etc.: it takes
+// h.mu only long enough to serialize with operations already in progress,
+// then zeroes the Heap (h.mu included), which would itself race a mutation
+// still in flight.
 func (h *Heap) Close() {
+	h.mu.Lock()
 	h.f.Close()
+	if h.wal != nil {
+		h.wal.close()
+	}
+	if h.relocFile != nil {
+		h.relocFile.Close()
+	}
+	h.mu.Unlock()
 	*h = Heap{}
 }
 
+// Commit durably persists every mutation made since the heap was opened or
+// last committed: it flushes the heap file (which also flushes the dirty
+// mmap'd region pages backing it, since they're the same file), then
+// fsyncs the redo log and truncates it, since everything it recorded is
+// now safely on disk and replaying it again would be redundant.
+func (h *Heap) Commit() error {
+	if err := h.f.Sync(); err != nil {
+		return err
+	}
+	if h.relocFile != nil {
+		if err := h.relocFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if h.wal == nil {
+		return nil
+	}
+	return h.wal.checkpoint()
+}
+
+// Recover replays the on-disk redo log from the start, bringing every
+// region back to the state recorded by the last mutation made before a
+// crash. OpenForUpdate does the same replay automatically (before it
+// attaches the log, so it doesn't re-log what it restores; Recover runs
+// with the log attached, so it does re-log it); it's exported so a caller
+// that suspects a partial write (e.g. after an I/O error) can force it.
+func (h *Heap) Recover() error {
+	if h.wal == nil {
+		return nil
+	}
+	records, err := readWALRecords(h.wal.f)
+	if err != nil {
+		return err
+	}
+	h.replay(records)
+	return nil
+}
+
+// replay reapplies a sequence of redo records directly to this heap's
+// regions.
+func (h *Heap) replay(records []walRecord) {
+	for _, rec := range records {
+		if rec.region < 0 || int(rec.region) >= len(h.regions) {
+			continue
+		}
+		r := h.regions[rec.region]
+		switch rec.op {
+		case walSetEntry:
+			r.setBlockListEntryFull(rec.blockId, rec.offset, rec.size, rec.flags, rec.uncompressedSize)
+		case walSetFreePointer:
+			r.setFreePointer(rec.offset)
+		case walSetNextBlockId:
+			r.setNextFreeBlockId(rec.blockId)
+		}
+	}
+	for _, r := range h.regions {
+		r.rebuildFreeList()
+	}
+}
+
+// Transaction runs fn, then durably commits everything it did in a single
+// Commit call. Mutations happen directly against the mmap'd regions as fn
+// runs, same as calling Allocate/Free/etc. outside a transaction would; if
+// fn returns an error, whatever it already did is NOT rolled back, only
+// left uncommitted, so a crash before the next successful Commit will
+// still replay it. Transaction exists to amortize Commit's fsync cost
+// across a batch of mutations, not to provide rollback.
+func (h *Heap) Transaction(fn func(*Heap) error) error {
+	if err := fn(h); err != nil {
+		return err
+	}
+	return h.Commit()
+}
+
 func (h *Heap) Available() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	c := int64(0)
 	for _, r := range h.regions {
 		c += r.Available()
@@ -80,23 +220,117 @@ func (h *Heap) Available() int64 {
 	return c
 }
 
+// resolveBlockId follows h.relocations and any in-region relocation
+// markers left by Compact until id lands on a region and BlockId that
+// isn't itself a forwarding pointer. GetBlock and Free both resolve
+// through this, so a block moved since the caller last looked it up
+// still reads and frees correctly either way.
+func (h *Heap) resolveBlockId(id BlockId) (*region, BlockId, bool) {
+	for hops := 0; hops < maxRelocationHops; hops++ {
+		h.mu.RLock()
+		target, ok := h.relocations[id]
+		if !ok && (id.RegionId() < 0 || int(id.RegionId()) >= len(h.regions)) {
+			h.mu.RUnlock()
+			return nil, 0, false
+		}
+		var r *region
+		if !ok {
+			r = h.regions[id.RegionId()]
+		}
+		h.mu.RUnlock()
+		if ok {
+			id = target
+			continue
+		}
+		if target, ok := r.resolveRelocation(id); ok {
+			id = target
+			continue
+		}
+		return r, id, true
+	}
+	return nil, 0, false
+}
+
 func (h *Heap) GetBlock(id BlockId) *Block {
-	r := h.regions[id.RegionId()]
+	r, id, ok := h.resolveBlockId(id)
+	if !ok {
+		return nil
+	}
 	return r.GetBlock(id)
 }
 
 // Return number of blocks allocated.
 func (h *Heap) Blocks() []*Block {
+	h.mu.RLock()
+	regions := append([]*region(nil), h.regions...)
+	h.mu.RUnlock()
 	blocks := make([]*Block, 0, 128)
-	for _, r := range h.regions {
+	for _, r := range regions {
 		blocks = append(blocks, r.Blocks()...)
 	}
 	return blocks
 }
 
+// Allocate reserves size bytes and returns the Block backing them. It tries
+// every existing region before growing the heap, taking h.mu only long
+// enough to do each (read-only or growing) pass; the actual bookkeeping for
+// a given region happens under that region's own lock, in region.Allocate.
 func (h *Heap) Allocate(size int64) (*Block, error) {
-	var r *region
-	for _, r = range h.regions {
+	if b, err := h.tryAllocate(size); b != nil || err != OutOfMemory {
+		return b, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		b, err := h.growAndAllocateLocked(size)
+		if err != OutOfMemory {
+			return b, err
+		}
+	}
+}
+
+// AllocateN reserves n blocks of the given sizes in one call, taking h.mu
+// once for the whole batch rather than once per size (plus, per region
+// visited, that region's own lock, same as any other allocation), which
+// amortizes h.mu's cost for a caller allocating many blocks back to back.
+// The returned slice has one entry per element of sizes, in the same order;
+// on error, the blocks already allocated before the failing size are left
+// allocated, not rolled back.
+func (h *Heap) AllocateN(sizes []int64) ([]*Block, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	blocks := make([]*Block, 0, len(sizes))
+	for _, size := range sizes {
+		b, err := h.allocateLocked(size)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// allocateLocked is Allocate's body for a caller that already holds h.mu for
+// writing, retrying growAndAllocateLocked (which assumes the same) until it
+// stops failing with OutOfMemory.
+func (h *Heap) allocateLocked(size int64) (*Block, error) {
+	for {
+		b, err := h.growAndAllocateLocked(size)
+		if err != OutOfMemory {
+			return b, err
+		}
+	}
+}
+
+// tryAllocate attempts size against every existing region under a read
+// lock, so concurrent allocations that all fit in already-allocated
+// capacity never contend with each other. Returns (nil, OutOfMemory) if the
+// heap needs to grow, which Allocate takes as its cue to retry under the
+// write lock.
+func (h *Heap) tryAllocate(size int64) (*Block, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, r := range h.regions {
 		b, err := r.Allocate(size)
 		if err == nil {
 			return b, nil
@@ -105,27 +339,58 @@ func (h *Heap) Allocate(size int64) (*Block, error) {
 			return nil, err
 		}
 	}
+	return nil, OutOfMemory
+}
+
+// growAndAllocateLocked is tryAllocate's counterpart for when the heap
+// needs to grow: called with h.mu already held for writing, it retries
+// every region once more (another goroutine may have grown the heap first)
+// and only appends a new region if they're still all full.
+func (h *Heap) growAndAllocateLocked(size int64) (*Block, error) {
+	var last *region
+	for _, last = range h.regions {
+		b, err := last.Allocate(size)
+		if err == nil {
+			return b, nil
+		}
+		if err != OutOfMemory {
+			return nil, err
+		}
+	}
 	// Ensure the new region has enough capacity to fit the new block.
-	regionSize := r.Size()
+	regionSize := last.Size()
 	for regionSize < size {
 		regionSize *= 2
 	}
-	// If we've hit here we need to add another region...
-	r, err := appendRegion(r.id+1, h.f, regionSize)
+	r, err := appendRegion(last.id+1, h.f, regionSize, h.opts)
 	if err != nil {
 		return nil, err
 	}
+	r.log = h.wal
 	h.regions = append(h.regions, r)
-	return h.Allocate(size)
+	return nil, OutOfMemory
 }
 
 func (h *Heap) Free(b *Block) bool {
-	r := h.regions[b.Id.RegionId()]
+	r, id, ok := h.resolveBlockId(b.Id)
+	if !ok {
+		return false
+	}
+	if id != b.Id {
+		// b.Id was relocated since the caller got this Block; refetch it
+		// at its current location so the Offset/Size r.Free acts on
+		// actually match where the bytes live now.
+		nb := r.GetBlock(id)
+		if nb == nil {
+			return false
+		}
+		b = nb
+	}
 	return r.Free(b)
 }
 
 // Internal methods
-func initHeap(f *os.File, writeable bool) (*Heap, error) {
+func initHeap(f *os.File, writeable bool, opts Options) (*Heap, error) {
 	regions := make([]*region, 0, 16)
 	offset := int64(0)
 	i, err := f.Stat()
@@ -133,7 +398,7 @@ func initHeap(f *os.File, writeable bool) (*Heap, error) {
 		return nil, err
 	}
 	for offset < i.Size() {
-		region, err := openRegion(f, writeable, offset)
+		region, err := openRegion(f, writeable, offset, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -142,6 +407,7 @@ func initHeap(f *os.File, writeable bool) (*Heap, error) {
 	}
 	h := &Heap{
 		f:       f,
+		opts:    opts,
 		regions: regions,
 	}
 	return h, nil
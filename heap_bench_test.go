@@ -0,0 +1,96 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+import (
+	"os"
+	"testing"
+)
+
+// newBenchHeap opens a fresh, empty heap backed by a temp file, registering
+// cleanup of the heap file and its WAL/relocation siblings.
+func newBenchHeap(b *testing.B) *Heap {
+	f, err := os.CreateTemp("", "vheap-bench-*.heap")
+	if err != nil {
+		b.Fatal(err)
+	}
+	name := f.Name()
+	f.Close()
+	os.Remove(name)
+	h, err := OpenForUpdate(name, 16, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		h.Close()
+		os.Remove(name)
+		os.Remove(name + ".wal")
+		os.Remove(name + ".reloc")
+	})
+	return h
+}
+
+// BenchmarkAllocateParallel measures Allocate's throughput under concurrent,
+// allocation-heavy load across GOMAXPROCS goroutines, exercising the
+// read-locked tryAllocate fast path (every region already has room) for
+// almost all of the run.
+func BenchmarkAllocateParallel(b *testing.B) {
+	h := newBenchHeap(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := h.Allocate(64); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkAllocateNParallel is BenchmarkAllocateParallel's counterpart for
+// the batch API, allocating the same blocks n at a time per h.mu acquisition
+// instead of one at a time, to show what batching buys over plain Allocate
+// under the same concurrent load.
+func BenchmarkAllocateNParallel(b *testing.B) {
+	h := newBenchHeap(b)
+	sizes := make([]int64, 8)
+	for i := range sizes {
+		sizes[i] = 64
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := h.AllocateN(sizes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkAllocateFreeParallel measures a steady-state allocate/free churn,
+// the workload tryAllocate's free-list reuse path and Free's own locking are
+// meant for, under concurrent load.
+func BenchmarkAllocateFreeParallel(b *testing.B) {
+	h := newBenchHeap(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			blk, err := h.Allocate(64)
+			if err != nil {
+				b.Fatal(err)
+			}
+			h.Free(blk)
+		}
+	})
+}
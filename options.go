@@ -0,0 +1,38 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+// FitStrategy selects how a region picks a free run to satisfy an Allocate
+// call once the free list has candidates to offer.
+type FitStrategy int
+
+const (
+	// FirstFit reuses the first free run large enough for the request. It's
+	// cheap and keeps fragmentation low for workloads with similarly sized
+	// blocks.
+	FirstFit FitStrategy = iota
+	// BestFit scans every free run and reuses the smallest one that fits,
+	// trading allocation time for tighter packing.
+	BestFit
+)
+
+// Options configures a Heap opened with OpenForUpdate.
+type Options struct {
+	// FitStrategy controls how free space is reused. Defaults to FirstFit.
+	FitStrategy FitStrategy
+	// Codec, if set, compresses block contents on Block.Commit and
+	// transparently decompresses them on read. Defaults to no compression.
+	Codec Codec
+}
@@ -16,26 +16,66 @@ package vheap
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"sort"
+	"sync"
 	"syscall"
-	"unsafe"
 )
 
 const (
-	regionHeaderSize        = 32
+	// legacyRegionHeaderSize is the header size used by every format
+	// version before 3, back when there was no room reserved for a CRC.
+	// openRegion still reads this many bytes to find a pre-3 region's
+	// fixed fields, which all live at the same offsets in both layouts.
+	legacyRegionHeaderSize = 40
+
+	regionHeaderSize        = 48
 	regionSignature         = 0
 	regionFreePointerOffset = 8
 	regionSizeOffset        = 16
 	regionId                = 24
+	regionFormatVersion     = 32
+	// regionCRCOffset holds a CRC32C (Castagnoli) over header[:regionCRCOffset],
+	// recomputed by updateHeaderCRC whenever a header field changes. Only
+	// meaningful from format version 3 onward; legacy regions don't have
+	// one and aren't checked.
+	regionCRCOffset = 40
+
+	// currentFormatVersion is written into new regions. Bumped whenever the
+	// on-disk layout changes. Version 3 switched every field from a raw
+	// host-endian int64 (via unsafe.Pointer) to an explicit little-endian
+	// encoding (via encoding/binary), so a region file is now portable
+	// between hosts of either endianness, and added the header CRC above.
+	currentFormatVersion = 3
 
 	// Block list offsets from top of region
 	blockListHeaderSize = 8 // Size of header
 	blockListNextIdPtr  = 0
 
-	// Size of each entry in the block list
-	blockListEntrySize = 16 // Size of each entry in the block list (offset, size int64)
+	// Size of each entry in the block list: offset int64, size int64
+	// (negative denotes a free run), a one-byte flag set, seven bytes of
+	// padding, and the uncompressed size int64 (valid only when
+	// blockFlagCompressed is set).
+	blockListEntrySize           = 32
+	blockListEntryOffsetOffset   = 0
+	blockListEntrySizeOffset     = 8
+	blockListEntryFlagsOffset    = 16
+	blockListEntryUncompressedOffset = 24
+
+	// blockFlagCompressed marks a block-list entry whose stored bytes are
+	// the codec's compressed form of a larger uncompressed block.
+	blockFlagCompressed = 1 << 0
+
+	// blockFlagRelocated marks a block-list entry that no longer holds
+	// (offset, size) directly: its offset field instead holds the raw
+	// BlockId the block was moved to by Compact, and its size/uncompressed
+	// fields are unused. Lets a block move region without invalidating the
+	// BlockId callers already hold.
+	blockFlagRelocated = 1 << 1
 )
 
 var (
@@ -49,6 +89,38 @@ type region struct {
 	d                  []byte
 	freePtr            []byte
 	blockListNextIdPtr []byte
+	fitStrategy        FitStrategy
+	codec              Codec
+	// mu serializes Allocate, Free, Commit and compact against each other,
+	// since each is a read-then-write sequence against freePtr,
+	// blockListNextIdPtr and the block list that isn't safe to interleave.
+	// It does not guard reads (GetBlock, Blocks, Available): those only
+	// need a block's bytes to stay put until freed, which mmap already
+	// gives them, and Allocate/compact already hold mu while calling some
+	// of them internally, so a reentrant lock there would deadlock.
+	mu sync.Mutex
+	// legacy marks a region opened from a pre-format-3 file that hasn't
+	// been migrated: either it was opened read-only, where migration is
+	// never attempted, or it couldn't be migrated in place (see migrate).
+	// Its header and block list are
+	// still read and written host-endian, with no CRC, exactly as they
+	// always were.
+	legacy bool
+	// log, when set, receives a redo record for every block-list/free
+	// pointer mutation before it's applied, so a crash mid-mutation can be
+	// repaired by replaying the log. Left nil during initial load/recovery.
+	log *walLog
+	// freeList tracks reusable (offset, size) runs recorded in vacated
+	// block-list slots, kept sorted by offset and fully coalesced.
+	freeList []freeRun
+}
+
+// freeRun describes a reusable span of region bytes, still recorded under
+// its original block-list slot so it survives a close/reopen cycle.
+type freeRun struct {
+	id     BlockId
+	offset int64
+	size   int64
 }
 
 type BlockId int64
@@ -56,9 +128,27 @@ type BlockId int64
 type Block struct {
 	region *region
 	Id     BlockId
+	// Bytes is the block's stored content. Reading it from multiple
+	// goroutines at once is safe against other readers and against plain
+	// allocation, since Allocate never moves or overwrites a live block's
+	// bytes in place. Commit and Heap.Compact do move or overwrite bytes
+	// in place, though (Compact to slide a live block down to a lower
+	// offset, Commit for the block being committed itself), Free hands a
+	// block's bytes back for a later Allocate to reuse, and none of them
+	// are guarded against a concurrent read of the same bytes. It's the caller's job to make sure nothing
+	// is reading a Block's Bytes while a concurrent Free or Commit
+	// targets that same Block, or while a concurrent Compact is running
+	// against its region at all, same as it's always been for a
+	// single-threaded caller passing a Block to the wrong place at the
+	// wrong time.
 	Bytes  []byte
 	Size   int64
 	Offset int64
+
+	// compressed records whether the bytes currently on disk for this
+	// block are in the codec's compressed form. Set by rawGetBlock and
+	// kept in sync by Commit.
+	compressed bool
 }
 
 // BlockId
@@ -86,6 +176,49 @@ func (b *Block) String() string {
 	return fmt.Sprintf("Block{Id: %v, Size: %d, Offset: %d}", b.Id, b.Size, b.Offset)
 }
 
+// Commit persists b.Bytes to the region. If the region has a Codec
+// configured and compressing shrinks b.Bytes, the compressed form is
+// stored and any space it frees up is returned to the free list; otherwise
+// the bytes are stored as-is. Commit returns BlockTooLarge if the (possibly
+// compressed) data doesn't fit in b's current span (b.Size), which an
+// earlier compressed Commit may already have shrunk below what was
+// originally allocated.
+func (b *Block) Commit() error {
+	r := b.region
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := b.Bytes
+	stored := data
+	flags := byte(0)
+	uncompressedSize := int64(0)
+	if r.codec != nil {
+		compressed, err := r.codec.Compress(data)
+		if err != nil {
+			return err
+		}
+		if int64(len(compressed)) < int64(len(data)) {
+			stored = compressed
+			flags = blockFlagCompressed
+			uncompressedSize = int64(len(data))
+		}
+	}
+	storedSize := int64(len(stored))
+	if storedSize > b.Size {
+		return BlockTooLarge
+	}
+	copy(r.d[b.Offset:b.Offset+storedSize], stored)
+	r.setBlockListEntryFull(b.Id, b.Offset, storedSize, flags, uncompressedSize)
+	if leftover := b.Size - storedSize; leftover > 0 {
+		leftoverId := r.incrementFreeBlockId()
+		leftoverOffset := b.Offset + storedSize
+		r.setBlockListEntry(leftoverId, leftoverOffset, -leftover)
+		r.insertFreeRun(freeRun{leftoverId, leftoverOffset, leftover})
+	}
+	b.Size = storedSize
+	b.compressed = flags&blockFlagCompressed != 0
+	return nil
+}
+
 // Size of region, including bookkeeping overhead.
 func (r *region) Size() int64 {
 	return int64(len(r.d))
@@ -96,13 +229,18 @@ func (r *region) Available() int64 {
 }
 
 func (r *region) Allocate(size int64) (*Block, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if size > r.Size() {
+		return nil, BlockTooLarge
+	}
+	if i, ok := r.findFreeRun(size); ok {
+		return r.allocateFromFreeRun(i, size), nil
+	}
 	offset := r.getFreePointer()
 	if size > r.Available() {
 		return nil, OutOfMemory
 	}
-	if size > r.Size() {
-		return nil, BlockTooLarge
-	}
 	id := r.getNextFreeBlockId()
 	r.setBlockListEntry(id, offset, size)
 	b := r.rawGetBlock(id)
@@ -113,21 +251,158 @@ func (r *region) Allocate(size int64) (*Block, error) {
 	return b, nil
 }
 
+// findFreeRun returns the index into r.freeList of a run large enough to
+// satisfy size, chosen according to r.fitStrategy.
+func (r *region) findFreeRun(size int64) (int, bool) {
+	best := -1
+	for i, fr := range r.freeList {
+		if fr.size < size {
+			continue
+		}
+		if r.fitStrategy == FirstFit {
+			return i, true
+		}
+		// BestFit: keep the tightest fit seen so far.
+		if best == -1 || fr.size < r.freeList[best].size {
+			best = i
+		}
+	}
+	return best, best != -1
+}
+
+// allocateFromFreeRun satisfies an allocation out of r.freeList[i], splitting
+// off and re-recording any leftover space under a fresh block-list slot.
+func (r *region) allocateFromFreeRun(i int, size int64) *Block {
+	fr := r.freeList[i]
+	r.setBlockListEntry(fr.id, fr.offset, size)
+	b := r.rawGetBlock(fr.id)
+	if fr.size == size {
+		r.freeList = append(r.freeList[:i], r.freeList[i+1:]...)
+	} else {
+		leftover := r.incrementFreeBlockId()
+		r.setBlockListEntry(leftover, fr.offset+size, -(fr.size - size))
+		r.freeList[i] = freeRun{leftover, fr.offset + size, fr.size - size}
+	}
+	return b
+}
+
 func (r *region) Free(b *Block) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	d := r.getBlockListEntryBytes(b.Id)
-	offset, size := *(*int64)(unsafe.Pointer(&d[0])), *(*int64)(unsafe.Pointer(&d[8]))
-	if offset == 0 && size == 0 {
+	offset, size := r.readInt64(d[0:8]), r.readInt64(d[8:16])
+	if size <= 0 {
 		return false
 	}
-	r.setBlockListEntry(b.Id, 0, 0)
-	// If we're the last block, wind back the heap.
-	if b.Id == r.getNextFreeBlockId()-1 {
+	// If we're the last block, wind back the heap instead of recording a
+	// free run for it.
+	if b.Id == r.getNextFreeBlockId()-1 && offset+size == r.getFreePointer() {
+		r.setBlockListEntry(b.Id, 0, 0)
 		r.setFreePointer(offset)
 		r.setNextFreeBlockId(b.Id)
+		return true
 	}
+	r.setBlockListEntry(b.Id, offset, -size)
+	r.insertFreeRun(freeRun{b.Id, offset, size})
 	return true
 }
 
+// insertFreeRun adds fr to r.freeList, coalescing with any free runs it's
+// adjacent to so the free list never holds two touching runs.
+func (r *region) insertFreeRun(fr freeRun) {
+	for merged := true; merged; {
+		merged = false
+		for i, other := range r.freeList {
+			switch {
+			case other.offset+other.size == fr.offset:
+				fr = r.mergeRuns(other, fr)
+			case fr.offset+fr.size == other.offset:
+				fr = r.mergeRuns(fr, other)
+			default:
+				continue
+			}
+			r.freeList = append(r.freeList[:i], r.freeList[i+1:]...)
+			merged = true
+			break
+		}
+	}
+	i := sort.Search(len(r.freeList), func(i int) bool { return r.freeList[i].offset >= fr.offset })
+	r.freeList = append(r.freeList, freeRun{})
+	copy(r.freeList[i+1:], r.freeList[i:])
+	r.freeList[i] = fr
+}
+
+// mergeRuns coalesces two adjacent free runs into one, keeping lo's
+// block-list slot as the canonical entry and retiring hi's slot.
+func (r *region) mergeRuns(lo, hi freeRun) freeRun {
+	size := lo.size + hi.size
+	r.setBlockListEntry(lo.id, lo.offset, -size)
+	r.setBlockListEntry(hi.id, 0, 0)
+	return freeRun{lo.id, lo.offset, size}
+}
+
+// rebuildFreeList scans the block list for free runs recorded in vacated
+// slots and reconstructs r.freeList from them. Called whenever a region is
+// opened, since the free list itself isn't persisted separately.
+func (r *region) rebuildFreeList() {
+	max := r.getNextFreeBlockId()
+	r.freeList = r.freeList[:0]
+	for i := NewBlockId(r.id, 0); i < max; i++ {
+		d := r.getBlockListEntryBytes(i)
+		offset, size := r.readInt64(d[0:8]), r.readInt64(d[8:16])
+		if size < 0 {
+			r.freeList = append(r.freeList, freeRun{i, offset, -size})
+		}
+	}
+	sort.Slice(r.freeList, func(a, b int) bool { return r.freeList[a].offset < r.freeList[b].offset })
+}
+
+// resolveRelocation reports whether id's slot holds a relocation marker
+// and, if so, the BlockId it now points to.
+func (r *region) resolveRelocation(id BlockId) (BlockId, bool) {
+	d := r.getBlockListEntryBytes(id)
+	if d[blockListEntryFlagsOffset]&blockFlagRelocated == 0 {
+		return 0, false
+	}
+	return BlockId(r.readInt64(d[blockListEntryOffsetOffset : blockListEntryOffsetOffset+8])), true
+}
+
+// setRelocation rewrites id's slot as a marker pointing to target, which
+// may live in a different region.
+func (r *region) setRelocation(id, target BlockId) {
+	r.setBlockListEntryFull(id, int64(target), 0, blockFlagRelocated, 0)
+}
+
+// compact rewrites this region's live blocks contiguously starting at the
+// region header, eliminating any internal fragmentation left behind by
+// frees. It doesn't touch block-list slot assignment, so every BlockId
+// still resolves to the same slot, just at a new offset.
+func (r *region) compact() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	live := r.Blocks()
+	sort.Slice(live, func(a, b int) bool { return live[a].Offset < live[b].Offset })
+	offset := int64(regionHeaderSize)
+	for _, b := range live {
+		if b.Offset != offset {
+			flags, uncompressedSize := r.getBlockListEntry(b.Id)
+			copy(r.d[offset:offset+b.Size], r.d[b.Offset:b.Offset+b.Size])
+			r.setBlockListEntryFull(b.Id, offset, b.Size, flags, uncompressedSize)
+		}
+		offset += b.Size
+	}
+	r.setFreePointer(offset)
+	// Every free run compact just reclaimed is now stale: its (offset,
+	// -size) still names a slot beyond the new, smaller freePtr. Retire
+	// those slots to (0, 0) rather than just dropping them from
+	// r.freeList, or rebuildFreeList/a stray direct read would resurrect
+	// an out-of-bounds run the next time this region is reopened.
+	for _, fr := range r.freeList {
+		r.setBlockListEntry(fr.id, 0, 0)
+	}
+	r.freeList = r.freeList[:0]
+}
+
 // Return array of allocated ids in this region
 func (r *region) Blocks() []*Block {
 	max := r.getNextFreeBlockId()
@@ -151,25 +426,54 @@ func (r *region) GetBlock(id BlockId) *Block {
 // Internal functions
 func (r *region) rawGetBlock(id BlockId) *Block {
 	d := r.getBlockListEntryBytes(id)
-	offset, size := *(*int64)(unsafe.Pointer(&d[0])), *(*int64)(unsafe.Pointer(&d[8]))
-	if offset == 0 || size == 0 {
+	if d[blockListEntryFlagsOffset]&blockFlagRelocated != 0 {
+		// Resolved by Heap.GetBlock, which knows how to follow a relocation
+		// into another region.
+		return nil
+	}
+	offset, size := r.readInt64(d[0:8]), r.readInt64(d[8:16])
+	// size <= 0 covers both never-allocated slots (0, 0) and free runs
+	// (offset, -size).
+	if size <= 0 {
 		return nil
 	}
-	return &Block{
-		region: r,
-		Id:     id,
-		Bytes:  r.d[offset : offset+size],
-		Size:   size,
-		Offset: offset,
+	stored := r.d[offset : offset+size]
+	flags, uncompressedSize := r.getBlockListEntry(id)
+	b := &Block{
+		region:     r,
+		Id:         id,
+		Size:       size,
+		Offset:     offset,
+		compressed: flags&blockFlagCompressed != 0,
 	}
+	if b.compressed {
+		// No codec, or a codec that can't make sense of what's stored:
+		// report the block missing rather than silently handing back its
+		// still-compressed bytes as if they were the real content.
+		if r.codec == nil {
+			return nil
+		}
+		decoded, err := r.codec.Decompress(stored, uncompressedSize)
+		if err != nil {
+			return nil
+		}
+		b.Bytes = decoded
+		return b
+	}
+	b.Bytes = stored
+	return b
 }
 
-func openRegion(f *os.File, writeable bool, offset int64) (*region, error) {
+func openRegion(f *os.File, writeable bool, offset int64, opts Options) (*region, error) {
 	_, err := f.Seek(offset, os.SEEK_SET)
 	if err != nil {
 		return nil, err
 	}
-	header := make([]byte, regionHeaderSize)
+	// legacyRegionHeaderSize bytes is enough to read every fixed field at
+	// or before regionFormatVersion, which live at the same offsets in
+	// every format version; whether the trailing CRC field is meaningful
+	// depends on the version we find there.
+	header := make([]byte, legacyRegionHeaderSize)
 	_, err = f.Read(header)
 	if err != nil {
 		return nil, err
@@ -177,8 +481,19 @@ func openRegion(f *os.File, writeable bool, offset int64) (*region, error) {
 	if bytes.Compare(header[:8], signature) != 0 {
 		return nil, InvalidSignature
 	}
-	size := *(*int64)(unsafe.Pointer(&header[regionSizeOffset]))
-	rid := *(*int64)(unsafe.Pointer(&header[regionId]))
+	// The format version is always little-endian from the version it
+	// names onward, so reading it via getInt64 works for both legacy and
+	// current regions on a host of either endianness: on this process's
+	// own host, legacy regions were written host-endian, which only
+	// differs from little-endian on a big-endian host, and in that case
+	// the version field is exactly as ambiguous as the rest of the
+	// legacy format until migrate() fixes it.
+	size := getInt64(header[regionSizeOffset : regionSizeOffset+8])
+	rid := getInt64(header[regionId : regionId+8])
+	version := getInt64(header[regionFormatVersion : regionFormatVersion+8])
+	if version > currentFormatVersion {
+		return nil, fmt.Errorf("region format version %d is newer than this package supports (%d)", version, currentFormatVersion)
+	}
 	flags := syscall.PROT_READ
 	if writeable {
 		flags |= syscall.PROT_WRITE
@@ -193,11 +508,25 @@ func openRegion(f *os.File, writeable bool, offset int64) (*region, error) {
 		d:                  d,
 		freePtr:            d[regionFreePointerOffset : regionFreePointerOffset+8],
 		blockListNextIdPtr: d[len(d)-8 : len(d)],
+		fitStrategy:        opts.FitStrategy,
+		codec:              opts.Codec,
+		legacy:             version < currentFormatVersion,
+	}
+	if !r.legacy && !r.headerCRCValid() {
+		syscall.Munmap(d)
+		return nil, InvalidChecksum
 	}
+	if r.legacy && writeable {
+		// Ignore a migration failure: r.legacy is already true, so the
+		// region just keeps running in legacy mode. See migrate's doc
+		// comment for when that happens.
+		r.migrate()
+	}
+	r.rebuildFreeList()
 	return r, nil
 }
 
-func appendRegion(rid int64, f *os.File, regionSizeB int64) (*region, error) {
+func appendRegion(rid int64, f *os.File, regionSizeB int64, opts Options) (*region, error) {
 	size, err := f.Seek(0, os.SEEK_END)
 	if err != nil {
 		return nil, err
@@ -209,13 +538,15 @@ func appendRegion(rid int64, f *os.File, regionSizeB int64) (*region, error) {
 	// Initialize header
 	header := make([]byte, regionHeaderSize)
 	copy(header[:8], signature)
-	*(*int64)(unsafe.Pointer(&header[regionFreePointerOffset])) = regionHeaderSize
-	*(*int64)(unsafe.Pointer(&header[regionSizeOffset])) = regionSizeB
-	*(*int64)(unsafe.Pointer(&header[regionId])) = rid
+	putInt64(header[regionFreePointerOffset:regionFreePointerOffset+8], regionHeaderSize)
+	putInt64(header[regionSizeOffset:regionSizeOffset+8], regionSizeB)
+	putInt64(header[regionId:regionId+8], rid)
+	putInt64(header[regionFormatVersion:regionFormatVersion+8], currentFormatVersion)
+	binary.LittleEndian.PutUint32(header[regionCRCOffset:regionCRCOffset+4], crc32.Checksum(header[:regionCRCOffset], crc32cTable))
 	if _, err := f.Write(header); err != nil {
 		return nil, err
 	}
-	r, err := openRegion(f, true, size)
+	r, err := openRegion(f, true, size, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -224,31 +555,64 @@ func appendRegion(rid int64, f *os.File, regionSizeB int64) (*region, error) {
 }
 
 func (r *region) getNextFreeBlockId() BlockId {
-	return NewBlockId(r.id, *(*int64)(unsafe.Pointer(&r.blockListNextIdPtr[0])))
+	return NewBlockId(r.id, r.readInt64(r.blockListNextIdPtr))
 }
 
 func (r *region) setNextFreeBlockId(id BlockId) {
-	*(*int64)(unsafe.Pointer(&r.blockListNextIdPtr[0])) = id.BlockId()
+	r.logMutation(walRecord{op: walSetNextBlockId, region: r.id, blockId: id})
+	r.writeInt64(r.blockListNextIdPtr, id.BlockId())
 }
 
 func (r *region) incrementFreeBlockId() BlockId {
 	id := r.getNextFreeBlockId()
-	*(*int64)(unsafe.Pointer(&r.blockListNextIdPtr[0])) = id.BlockId() + 1
+	r.setNextFreeBlockId(NewBlockId(r.id, id.BlockId()+1))
 	return id
 }
 
 func (r *region) getFreePointer() int64 {
-	return *(*int64)(unsafe.Pointer(&r.freePtr[0]))
+	return r.readInt64(r.freePtr)
 }
 
 func (r *region) setFreePointer(offset int64) {
-	*(*int64)(unsafe.Pointer(&r.freePtr[0])) = offset
+	r.logMutation(walRecord{op: walSetFreePointer, region: r.id, offset: offset})
+	r.writeInt64(r.freePtr, offset)
+	if !r.legacy {
+		r.updateHeaderCRC()
+	}
 }
 
 func (r *region) setBlockListEntry(id BlockId, offset, size int64) {
+	r.setBlockListEntryFull(id, offset, size, 0, 0)
+}
+
+// setBlockListEntryFull sets every field of a block-list entry, including
+// the compression flags and uncompressed size recorded by Block.Commit.
+func (r *region) setBlockListEntryFull(id BlockId, offset, size int64, flags byte, uncompressedSize int64) {
+	r.logMutation(walRecord{op: walSetEntry, region: r.id, blockId: id, offset: offset, size: size, flags: flags, uncompressedSize: uncompressedSize})
+	d := r.getBlockListEntryBytes(id)
+	r.writeInt64(d[blockListEntryOffsetOffset:blockListEntryOffsetOffset+8], offset)
+	r.writeInt64(d[blockListEntrySizeOffset:blockListEntrySizeOffset+8], size)
+	d[blockListEntryFlagsOffset] = flags
+	r.writeInt64(d[blockListEntryUncompressedOffset:blockListEntryUncompressedOffset+8], uncompressedSize)
+}
+
+// logMutation appends a redo record for a mutation about to be applied, if
+// this region has a WAL attached. Best-effort: a failure to log doesn't
+// block the mutation, mirroring how the rest of this package treats
+// allocator bookkeeping as non-atomic already.
+func (r *region) logMutation(rec walRecord) {
+	if r.log == nil {
+		return
+	}
+	r.log.append(rec)
+}
+
+// getBlockListEntry reads the flags and uncompressed size recorded for id.
+// Callers that only need (offset, size) can keep reading those two fields
+// directly, as the rest of the package already does.
+func (r *region) getBlockListEntry(id BlockId) (flags byte, uncompressedSize int64) {
 	d := r.getBlockListEntryBytes(id)
-	*(*int64)(unsafe.Pointer(&d[0])) = offset
-	*(*int64)(unsafe.Pointer(&d[8])) = size
+	return d[blockListEntryFlagsOffset], r.readInt64(d[blockListEntryUncompressedOffset : blockListEntryUncompressedOffset+8])
 }
 
 func (r *region) getBlockListEntryBytes(id BlockId) []byte {
@@ -258,5 +622,5 @@ func (r *region) getBlockListEntryBytes(id BlockId) []byte {
 }
 
 func (r *region) initBlockList() {
-	*(*int64)(unsafe.Pointer(&r.blockListNextIdPtr[0])) = 0
+	r.writeInt64(r.blockListNextIdPtr, 0)
 }
@@ -0,0 +1,66 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// relocationRecordSize is the on-disk size of one persisted relocation:
+// the BlockId it forwards from, and the BlockId it forwards to.
+const relocationRecordSize = 16
+
+// openRelocations opens (creating if necessary) the durable relocation
+// table at path, alongside the heap file, and returns every entry recorded
+// in it so far. Unlike the WAL, this file is never truncated: a relocation
+// stays valid for the rest of the heap file's life, since the BlockId it
+// forwards from may have come from a region TruncateEmptyRegions has since
+// dropped, with nowhere else left to record it.
+func openRelocations(path string) (*os.File, map[BlockId]BlockId, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	relocations := map[BlockId]BlockId{}
+	buf := make([]byte, relocationRecordSize)
+	for {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			break
+		}
+		id := BlockId(binary.LittleEndian.Uint64(buf[0:8]))
+		target := BlockId(binary.LittleEndian.Uint64(buf[8:16]))
+		relocations[id] = target
+	}
+	return f, relocations, nil
+}
+
+// appendRelocation durably records that id now resolves to target, before
+// the caller lets go of whatever let it resolve that way in memory (e.g.
+// before TruncateEmptyRegions drops the region holding id's relocation
+// marker).
+func appendRelocation(f *os.File, id, target BlockId) error {
+	if _, err := f.Seek(0, os.SEEK_END); err != nil {
+		return err
+	}
+	buf := make([]byte, relocationRecordSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(id))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(target))
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	return f.Sync()
+}
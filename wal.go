@@ -0,0 +1,192 @@
+// Copyright 2012 Alec Thomas
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vheap
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// walOpcode identifies the physical mutation a walRecord replays. Records
+// are deliberately low-level (set this field to this value) rather than
+// high-level (allocate N bytes) so replaying one is just reapplying the
+// same write, with no allocator logic to get out of sync.
+type walOpcode byte
+
+const (
+	walSetEntry walOpcode = iota + 1
+	walSetFreePointer
+	walSetNextBlockId
+	// walCheckpoint marks everything before it as durably applied; a
+	// reader stops accumulating records and starts a fresh batch.
+	walCheckpoint
+)
+
+const walRecordSize = 1 + 8 + 8 + 8 + 8 + 8 + 1 + 8 // op, lsn, region, blockId, offset, size, flags, uncompressedSize
+
+// walRecord is a single redo-log entry.
+type walRecord struct {
+	op               walOpcode
+	lsn              uint64
+	region           int64
+	blockId          BlockId
+	offset           int64
+	size             int64
+	flags            byte
+	uncompressedSize int64
+}
+
+func encodeWALRecord(r walRecord) []byte {
+	buf := make([]byte, walRecordSize)
+	buf[0] = byte(r.op)
+	binary.LittleEndian.PutUint64(buf[1:9], r.lsn)
+	binary.LittleEndian.PutUint64(buf[9:17], uint64(r.region))
+	binary.LittleEndian.PutUint64(buf[17:25], uint64(r.blockId))
+	binary.LittleEndian.PutUint64(buf[25:33], uint64(r.offset))
+	binary.LittleEndian.PutUint64(buf[33:41], uint64(r.size))
+	buf[41] = r.flags
+	binary.LittleEndian.PutUint64(buf[42:50], uint64(r.uncompressedSize))
+	return buf
+}
+
+func decodeWALRecord(buf []byte) (walRecord, error) {
+	if len(buf) < walRecordSize {
+		return walRecord{}, errors.New("vheap: truncated WAL record")
+	}
+	return walRecord{
+		op:               walOpcode(buf[0]),
+		lsn:              binary.LittleEndian.Uint64(buf[1:9]),
+		region:           int64(binary.LittleEndian.Uint64(buf[9:17])),
+		blockId:          BlockId(binary.LittleEndian.Uint64(buf[17:25])),
+		offset:           int64(binary.LittleEndian.Uint64(buf[25:33])),
+		size:             int64(binary.LittleEndian.Uint64(buf[33:41])),
+		flags:            buf[41],
+		uncompressedSize: int64(binary.LittleEndian.Uint64(buf[42:50])),
+	}, nil
+}
+
+// walLog is an append-only, checksummed redo log shared by every region in
+// a Heap. A record is written and, on Heap.Commit, fsynced before the log
+// is reset, so replaying it after a crash can bring a region's block list
+// back to a consistent state even if the crash happened mid-mutation.
+type walLog struct {
+	f       *os.File
+	nextLSN uint64
+}
+
+// openWAL opens (creating if necessary) the redo log at path and returns
+// it along with any records left over from an unfinished transaction, in
+// LSN order.
+func openWAL(path string) (*walLog, []walRecord, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, err := readWALRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	lsn := uint64(0)
+	for _, rec := range records {
+		if rec.lsn >= lsn {
+			lsn = rec.lsn + 1
+		}
+	}
+	return &walLog{f: f, nextLSN: lsn}, records, nil
+}
+
+// readWALRecords replays the log format: [uint32 length][payload][uint32
+// crc32]. It stops at the first short read or checksum mismatch, since
+// that's exactly what a torn write during a crash looks like, and resets
+// to empty at each walCheckpoint marker it sees.
+func readWALRecords(f *os.File) ([]walRecord, error) {
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	var records []walRecord
+	var lengthBuf, crcBuf [4]byte
+	for {
+		if _, err := io.ReadFull(f, lengthBuf[:]); err != nil {
+			break
+		}
+		length := binary.LittleEndian.Uint32(lengthBuf[:])
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(f, crcBuf[:]); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(crcBuf[:]) {
+			break
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			break
+		}
+		if rec.op == walCheckpoint {
+			records = records[:0]
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// append assigns rec the next LSN and writes it to the end of the log.
+func (w *walLog) append(rec walRecord) error {
+	rec.lsn = w.nextLSN
+	w.nextLSN++
+	payload := encodeWALRecord(rec)
+	if _, err := w.f.Seek(0, os.SEEK_END); err != nil {
+		return err
+	}
+	var lengthBuf, crcBuf [4]byte
+	binary.LittleEndian.PutUint32(lengthBuf[:], uint32(len(payload)))
+	if _, err := w.f.Write(lengthBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.f.Write(payload); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(crcBuf[:], crc32.ChecksumIEEE(payload))
+	_, err := w.f.Write(crcBuf[:])
+	return err
+}
+
+// checkpoint fsyncs the log, then truncates it: every record up to here
+// is presumed to have already been applied by the caller (see
+// Heap.Commit), so there's nothing left worth replaying.
+func (w *walLog) checkpoint() error {
+	if err := w.append(walRecord{op: walCheckpoint}); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := w.f.Seek(0, os.SEEK_SET)
+	return err
+}
+
+func (w *walLog) close() error {
+	return w.f.Close()
+}